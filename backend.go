@@ -0,0 +1,104 @@
+/**
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// Sample is a single timestamped datapoint handed to a Backend at flush
+// time. Key is already fully qualified (tags folded in per tagFormat, stats
+// prefix/suffix applied), so backends only need to serialize it.
+type Sample struct {
+	Key       string
+	Value     float64
+	Timestamp int64
+	Tags      map[string]string
+}
+
+// Backend is a pluggable metrics sink. Every configured backend receives
+// every flushed metric's samples; handleGraphiteQueue fans them out
+// concurrently so a slow backend can't hold up the others.
+type Backend interface {
+	Name() string
+	Send(ctx context.Context, samples []Sample) error
+	Close() error
+}
+
+// backends holds every configured Backend, populated by buildBackends once
+// the MetricStore exists.
+var backends []Backend
+
+// backendConfigs holds the raw `backends` YAML list entries, captured by
+// parseBackendsConfig during loadConfig.
+var backendConfigs []map[interface{}]interface{}
+
+// parseBackendsConfig reads the `backends` YAML list into backendConfigs.
+func parseBackendsConfig(raw []interface{}) {
+	backendConfigs = make([]map[interface{}]interface{}, 0, len(raw))
+	for _, entry := range raw {
+		backendConfigs = append(backendConfigs, entry.(map[interface{}]interface{}))
+	}
+}
+
+// buildBackends instantiates every backend named in backendConfigs. When no
+// `backends` section was present it defaults to a single plaintext Graphite
+// backend using graphiteHost/graphitePort, preserving pre-`backends:`
+// behavior.
+func buildBackends(store *MetricStore) []Backend {
+	if len(backendConfigs) == 0 {
+		addr := fmt.Sprintf("%s:%d", *graphiteHost, *graphitePort)
+		return []Backend{NewGraphiteBackend(addr, graphiteConfig, store)}
+	}
+
+	built := make([]Backend, 0, len(backendConfigs))
+	for _, m := range backendConfigs {
+		backendType, _ := m["type"].(string)
+
+		switch backendType {
+		case "graphite":
+			addr := backendAddr(m, *graphiteHost, *graphitePort)
+			built = append(built, NewGraphiteBackend(addr, graphiteConfig, store))
+		case "carbon_pickle":
+			addr := backendAddr(m, *graphiteHost, defaultCarbonPicklePort)
+			built = append(built, NewCarbonPickleBackend(addr))
+		case "file":
+			path, _ := m["path"].(string)
+			backend, err := NewFileBackend(path)
+			checkError(err, "Starting file backend", true)
+			built = append(built, backend)
+		default:
+			Warning.Printf("Unknown backend type %q, skipping", backendType)
+		}
+	}
+	return built
+}
+
+// backendAddr reads an optional host/port pair out of a single `backends`
+// YAML entry, falling back to the given defaults.
+func backendAddr(m map[interface{}]interface{}, defaultHost string, defaultPort int) string {
+	host := defaultHost
+	if m["host"] != nil {
+		host = m["host"].(string)
+	}
+
+	port := defaultPort
+	if m["port"] != nil {
+		port = m["port"].(int)
+	}
+
+	return fmt.Sprintf("%s:%d", host, port)
+}
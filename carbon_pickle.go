@@ -0,0 +1,144 @@
+/**
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// defaultCarbonPicklePort is Carbon's conventional pickle receiver port
+// (the plaintext line receiver defaults to 2003, pickle to 2004).
+const defaultCarbonPicklePort = 2004
+
+// CarbonPickleBackend sends samples to Carbon's pickle receiver: a 4-byte
+// big-endian length header followed by a Python pickle (protocol 0) encoded
+// list of (path, (timestamp, value)) tuples. The connection is dialed
+// lazily and redialed on the next Send after a write failure.
+type CarbonPickleBackend struct {
+	addr string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// NewCarbonPickleBackend builds a backend targeting addr; no connection is
+// made until the first Send.
+func NewCarbonPickleBackend(addr string) *CarbonPickleBackend {
+	return &CarbonPickleBackend{addr: addr}
+}
+
+// Name identifies this backend in logs.
+func (b *CarbonPickleBackend) Name() string {
+	return "carbon_pickle"
+}
+
+// Send pickles samples and writes them as one length-prefixed payload.
+func (b *CarbonPickleBackend) Send(ctx context.Context, samples []Sample) error {
+	if len(samples) == 0 {
+		return nil
+	}
+
+	payload := encodeCarbonPickle(samples)
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(payload)))
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.conn == nil {
+		conn, err := net.DialTimeout("tcp", b.addr, graphiteConfig.DialTimeout)
+		if err != nil {
+			return fmt.Errorf("carbon_pickle: dial %s: %v", b.addr, err)
+		}
+		b.conn = conn
+	}
+
+	if _, err := b.conn.Write(header); err != nil {
+		b.conn.Close()
+		b.conn = nil
+		return fmt.Errorf("carbon_pickle: write header to %s: %v", b.addr, err)
+	}
+
+	if _, err := b.conn.Write(payload); err != nil {
+		b.conn.Close()
+		b.conn = nil
+		return fmt.Errorf("carbon_pickle: write payload to %s: %v", b.addr, err)
+	}
+
+	return nil
+}
+
+// Close closes the underlying connection, if one is open.
+func (b *CarbonPickleBackend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.conn == nil {
+		return nil
+	}
+	err := b.conn.Close()
+	b.conn = nil
+	return err
+}
+
+// encodeCarbonPickle renders samples as a Python pickle protocol-0 encoded
+// list of (path, (timestamp, value)) tuples, the payload shape Carbon's
+// pickle receiver expects. It's a minimal, special-cased encoder for this
+// one data shape rather than a general-purpose pickler.
+func encodeCarbonPickle(samples []Sample) []byte {
+	var buf bytes.Buffer
+
+	buf.WriteString("(l")
+	for i, s := range samples {
+		memo := i*2 + 1
+
+		buf.WriteString("(S")
+		writePickleString(&buf, s.Key)
+		buf.WriteString("\np")
+		buf.WriteString(strconv.Itoa(memo))
+		buf.WriteString("\n(I")
+		buf.WriteString(strconv.FormatInt(s.Timestamp, 10))
+		buf.WriteString("\nF")
+		buf.WriteString(strconv.FormatFloat(s.Value, 'g', -1, 64))
+		buf.WriteString("\ntp")
+		buf.WriteString(strconv.Itoa(memo + 1))
+		buf.WriteString("\ntp")
+		buf.WriteString(strconv.Itoa(memo + 2))
+		buf.WriteString("\na")
+	}
+	buf.WriteString(".")
+
+	return buf.Bytes()
+}
+
+// writePickleString writes s as a single-quoted pickle STRING argument,
+// backslash-escaping single quotes and backslashes. Other characters,
+// including control and non-ASCII characters, are written as-is.
+func writePickleString(buf *bytes.Buffer, s string) {
+	buf.WriteByte('\'')
+	for _, r := range s {
+		if r == '\'' || r == '\\' {
+			buf.WriteByte('\\')
+		}
+		buf.WriteRune(r)
+	}
+	buf.WriteByte('\'')
+}
@@ -0,0 +1,79 @@
+/**
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// FileBackend writes samples as plaintext Graphite lines to a file, or to
+// stdout when path is empty or "-". Meant for local debugging, not
+// production use.
+type FileBackend struct {
+	path string
+
+	mu sync.Mutex
+	w  io.Writer
+	f  *os.File
+}
+
+// NewFileBackend opens path for appending, creating it if needed. path of
+// "" or "-" writes to stdout instead.
+func NewFileBackend(path string) (*FileBackend, error) {
+	if path == "" || path == "-" {
+		return &FileBackend{path: path, w: os.Stdout}, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("file backend: open %s: %v", path, err)
+	}
+	return &FileBackend{path: path, w: f, f: f}, nil
+}
+
+// Name identifies this backend in logs.
+func (b *FileBackend) Name() string {
+	return "file"
+}
+
+// Send writes each sample as a "key value timestamp" line.
+func (b *FileBackend) Send(ctx context.Context, samples []Sample) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, s := range samples {
+		sv := strconv.FormatFloat(s.Value, 'f', 6, 64)
+		if _, err := fmt.Fprintf(b.w, "%s %s %d\n", s.Key, sv, s.Timestamp); err != nil {
+			return fmt.Errorf("file backend: write to %s: %v", b.path, err)
+		}
+	}
+	return nil
+}
+
+// Close closes the underlying file, if one was opened.
+func (b *FileBackend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.f == nil {
+		return nil
+	}
+	return b.f.Close()
+}
@@ -0,0 +1,142 @@
+/**
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import "regexp"
+
+// rewriteRule rewrites a metric key matching Match to Replace, using Go's
+// regexp.ReplaceAllString syntax ("$1" for capture groups).
+type rewriteRule struct {
+	Match   *regexp.Regexp
+	Replace string
+}
+
+// FilterConfig holds the settings for the `filters` YAML section: which
+// metrics are accepted, how their keys are rewritten and decorated, and
+// whether a flushed metric is reset in place or deleted from the store.
+type FilterConfig struct {
+	Deny         []*regexp.Regexp
+	Allow        []*regexp.Regexp
+	Rewrites     []rewriteRule
+	Prefix       string
+	Suffix       string
+	ResetOnFlush map[string]bool
+}
+
+// filterConfig is the active filter configuration, populated by loadConfig.
+// With no `filters` section, every metric is accepted unmodified and
+// non-gauge metrics are deleted after flush (or reset in place when the
+// Prometheus exporter is enabled), matching pre-`filters:` behavior.
+var filterConfig = FilterConfig{
+	ResetOnFlush: map[string]bool{},
+}
+
+// parseFilterConfig reads the `filters` YAML section into filterConfig.
+func parseFilterConfig(m map[interface{}]interface{}) {
+	if m["deny"] != nil {
+		filterConfig.Deny = compileRegexpList(m["deny"].([]interface{}), "filters.deny")
+	}
+
+	if m["allow"] != nil {
+		filterConfig.Allow = compileRegexpList(m["allow"].([]interface{}), "filters.allow")
+	}
+
+	if m["rewrite"] != nil {
+		raw := m["rewrite"].([]interface{})
+		rewrites := make([]rewriteRule, 0, len(raw))
+		for _, entry := range raw {
+			rule := entry.(map[interface{}]interface{})
+			match := rule["match"].(string)
+			replace, _ := rule["replace"].(string)
+
+			re, err := regexp.Compile(match)
+			checkError(err, "Could not compile filters.rewrite pattern "+match, true)
+			rewrites = append(rewrites, rewriteRule{Match: re, Replace: replace})
+		}
+		filterConfig.Rewrites = rewrites
+	}
+
+	if m["prefix"] != nil {
+		filterConfig.Prefix = m["prefix"].(string)
+	}
+
+	if m["suffix"] != nil {
+		filterConfig.Suffix = m["suffix"].(string)
+	}
+
+	if m["resetOnFlush"] != nil {
+		raw := m["resetOnFlush"].(map[interface{}]interface{})
+		for k, v := range raw {
+			filterConfig.ResetOnFlush[k.(string)] = v.(bool)
+		}
+	}
+}
+
+// compileRegexpList compiles every pattern in raw, identifying the section
+// in error messages via context.
+func compileRegexpList(raw []interface{}, context string) []*regexp.Regexp {
+	patterns := make([]*regexp.Regexp, 0, len(raw))
+	for _, v := range raw {
+		pattern := v.(string)
+		re, err := regexp.Compile(pattern)
+		checkError(err, "Could not compile "+context+" pattern "+pattern, true)
+		patterns = append(patterns, re)
+	}
+	return patterns
+}
+
+// accepts reports whether key passes the configured deny/allow filters.
+// Deny takes priority; if any allow patterns are configured, key must match
+// at least one of them to be accepted.
+func (f FilterConfig) accepts(key string) bool {
+	for _, re := range f.Deny {
+		if re.MatchString(key) {
+			return false
+		}
+	}
+
+	if len(f.Allow) == 0 {
+		return true
+	}
+
+	for _, re := range f.Allow {
+		if re.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// rewrite applies every configured rewrite rule to key, in order.
+func (f FilterConfig) rewrite(key string) string {
+	for _, r := range f.Rewrites {
+		key = r.Match.ReplaceAllString(key, r.Replace)
+	}
+	return key
+}
+
+// shouldReset reports whether a flushed metric of metricType should be
+// reset in place (etsy-statsd semantics: stays in the store, counters reset
+// to 0) rather than deleted. It always returns false for gauges, which
+// handleGraphiteQueue keeps in place without resetting or deleting them,
+// regardless of configuration. Metrics feeding the Prometheus exporter are always reset
+// rather than deleted, so their collector keeps accumulating across
+// flushes instead of disappearing.
+func (f FilterConfig) shouldReset(metricType string) bool {
+	if metricType == "gauge" {
+		return false
+	}
+	return f.ResetOnFlush[metricType] || promConfig.Enabled
+}
@@ -0,0 +1,210 @@
+/**
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// droppedMetricKey is the self-monitoring counter incremented whenever the
+// GraphiteClient drops a line: because the spool was full, or because no
+// connection was open when the line was drained.
+const droppedMetricKey = "statsgod.graphite_client.dropped"
+
+// GraphiteConfig holds the settings for the `graphite` YAML section.
+type GraphiteConfig struct {
+	DialTimeout      time.Duration
+	WriteTimeout     time.Duration
+	SpoolSize        int
+	ReconnectBackoff time.Duration
+	ReconnectMax     time.Duration
+}
+
+// graphiteConfig is the active Graphite client configuration, populated by
+// loadConfig.
+var graphiteConfig = GraphiteConfig{
+	DialTimeout:      5 * time.Second,
+	WriteTimeout:     5 * time.Second,
+	SpoolSize:        10000,
+	ReconnectBackoff: 500 * time.Millisecond,
+	ReconnectMax:     30 * time.Second,
+}
+
+// GraphiteClient owns a single long-lived connection to Carbon and batches
+// writes through a buffered writer, instead of dialing a fresh connection
+// per datapoint. Lines are handed to it via Enqueue and spooled in a bounded
+// channel; the oldest spooled line is dropped if the spool is full so a slow
+// or unreachable Carbon never blocks metric ingestion.
+type GraphiteClient struct {
+	addr   string
+	config GraphiteConfig
+	store  *MetricStore
+
+	spool chan string
+
+	mu     sync.Mutex
+	conn   net.Conn
+	writer *bufio.Writer
+}
+
+// NewGraphiteClient builds a client dialing addr, spooling through store for
+// its self-monitoring dropped-count metric.
+func NewGraphiteClient(addr string, c GraphiteConfig, store *MetricStore) *GraphiteClient {
+	return &GraphiteClient{
+		addr:   addr,
+		config: c,
+		store:  store,
+		spool:  make(chan string, c.SpoolSize),
+	}
+}
+
+// Run connects and then services the spool until the process exits.
+func (c *GraphiteClient) Run() {
+	c.connectWithBackoff()
+	c.drain()
+}
+
+// Enqueue spools a single already-formatted "key value timestamp" line,
+// dropping the oldest spooled line to make room if the spool is full.
+func (c *GraphiteClient) Enqueue(line string) {
+	select {
+	case c.spool <- line:
+	default:
+		select {
+		case <-c.spool:
+			c.store.Set(droppedMetricKey, "counter", 1, nil, 1)
+		default:
+		}
+		select {
+		case c.spool <- line:
+		default:
+			c.store.Set(droppedMetricKey, "counter", 1, nil, 1)
+		}
+	}
+}
+
+// drain writes every spooled line through the buffered writer, flushing once
+// the spool has run dry so a flush tick's worth of lines goes out in
+// buffer-sized network writes rather than one per line.
+func (c *GraphiteClient) drain() {
+	for line := range c.spool {
+		c.write(line)
+
+		if len(c.spool) == 0 {
+			c.flush()
+		}
+	}
+}
+
+func (c *GraphiteClient) write(line string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		// Dropped the connection; the reconnect loop will pick it back up,
+		// so just drop this line rather than blocking ingestion on Carbon.
+		c.store.Set(droppedMetricKey, "counter", 1, nil, 1)
+		return
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(c.config.WriteTimeout))
+	if _, err := fmt.Fprintf(c.writer, "%s\n", line); err != nil {
+		Error.Printf("Graphite write failed, reconnecting: %v", err)
+		c.conn.Close()
+		c.conn = nil
+		go c.connectWithBackoff()
+	}
+}
+
+func (c *GraphiteClient) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.writer == nil || c.conn == nil {
+		return
+	}
+	if err := c.writer.Flush(); err != nil {
+		Error.Printf("Graphite flush failed, reconnecting: %v", err)
+		c.conn.Close()
+		c.conn = nil
+		go c.connectWithBackoff()
+	}
+}
+
+// connectWithBackoff dials addr, retrying with exponential backoff (capped
+// at ReconnectMax) until it succeeds.
+func (c *GraphiteClient) connectWithBackoff() {
+	backoff := c.config.ReconnectBackoff
+
+	for {
+		conn, err := net.DialTimeout("tcp", c.addr, c.config.DialTimeout)
+		if err == nil {
+			c.mu.Lock()
+			c.conn = conn
+			c.writer = bufio.NewWriter(conn)
+			c.mu.Unlock()
+			return
+		}
+
+		Error.Printf("Could not connect to Graphite at %s, retrying in %v: %v", c.addr, backoff, err)
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > c.config.ReconnectMax {
+			backoff = c.config.ReconnectMax
+		}
+	}
+}
+
+// GraphiteBackend adapts the pooled, reconnecting GraphiteClient to the
+// Backend interface.
+type GraphiteBackend struct {
+	client *GraphiteClient
+}
+
+// NewGraphiteBackend dials addr and starts the client's background drain
+// loop.
+func NewGraphiteBackend(addr string, c GraphiteConfig, store *MetricStore) *GraphiteBackend {
+	client := NewGraphiteClient(addr, c, store)
+	go client.Run()
+	return &GraphiteBackend{client: client}
+}
+
+// Name identifies this backend in logs.
+func (b *GraphiteBackend) Name() string {
+	return "graphite"
+}
+
+// Send spools each sample as a plaintext "key value timestamp" line onto
+// the pooled GraphiteClient.
+func (b *GraphiteBackend) Send(ctx context.Context, samples []Sample) error {
+	for _, s := range samples {
+		sv := strconv.FormatFloat(s.Value, 'f', 6, 64)
+		payload := fmt.Sprintf("%s %s %d", s.Key, sv, s.Timestamp)
+		b.client.Enqueue(payload)
+	}
+	return nil
+}
+
+// Close is a no-op; the underlying GraphiteClient has no explicit shutdown.
+func (b *GraphiteBackend) Close() error {
+	return nil
+}
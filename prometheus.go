@@ -0,0 +1,229 @@
+/**
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// PrometheusConfig holds the settings for the `prometheus` YAML section.
+type PrometheusConfig struct {
+	Enabled     bool
+	ListenAddr  string
+	Namespace   string
+	Buckets     []float64
+	Percentiles []float64
+}
+
+// promConfig is the active Prometheus configuration, populated by loadConfig.
+var promConfig = PrometheusConfig{
+	Enabled:     false,
+	ListenAddr:  ":9102",
+	Namespace:   "statsgod",
+	Buckets:     []float64{},
+	Percentiles: []float64{0.5, 0.9, 0.99},
+}
+
+// promPipeline carries flushed metrics over to the Prometheus exporter,
+// mirroring the role graphitePipeline plays for the Graphite sink.
+var promPipeline = make(chan Metric, MAXREQS)
+
+// PrometheusExporter mirrors stored metrics into a Prometheus registry and
+// serves them over HTTP for scraping. Metrics are registered as *Vec
+// collectors keyed by tag name, one Vec per distinct metric name, since two
+// metrics with the same name but different tag sets (chunk0-2) are
+// distinct Prometheus series sharing one collector, not distinct
+// collectors.
+type PrometheusExporter struct {
+	registry   *prometheus.Registry
+	namespace  string
+	buckets    []float64
+	objectives map[float64]float64
+
+	mu         sync.Mutex
+	gauges     map[string]*prometheus.GaugeVec
+	counters   map[string]*prometheus.CounterVec
+	timers     map[string]prometheus.ObserverVec
+	labelNames map[string][]string
+}
+
+// NewPrometheusExporter builds an exporter from the given config.
+func NewPrometheusExporter(c PrometheusConfig) *PrometheusExporter {
+	objectives := make(map[float64]float64, len(c.Percentiles))
+	for _, p := range c.Percentiles {
+		objectives[p] = 0.001
+	}
+
+	return &PrometheusExporter{
+		registry:   prometheus.NewRegistry(),
+		namespace:  c.Namespace,
+		buckets:    c.Buckets,
+		objectives: objectives,
+		gauges:     make(map[string]*prometheus.GaugeVec),
+		counters:   make(map[string]*prometheus.CounterVec),
+		timers:     make(map[string]prometheus.ObserverVec),
+		labelNames: make(map[string][]string),
+	}
+}
+
+// Serve starts an HTTP server exposing the registry on /metrics.
+func (e *PrometheusExporter) Serve(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(e.registry, promhttp.HandlerOpts{}))
+
+	Info.Printf("Starting Prometheus exporter on %s", addr)
+	server := &http.Server{Addr: addr, Handler: mux}
+	if err := server.ListenAndServe(); err != nil {
+		checkError(err, "Starting Prometheus exporter", false)
+	}
+}
+
+// Mirror copies a flushed Metric into the appropriate Prometheus collector,
+// registering a new Vec the first time a metric name is seen. A recover
+// keeps a panic from the collectors (Counter.Add panics on a negative
+// counter value, MustRegister on a conflicting registration) from taking
+// down handlePrometheusQueue and the rest of the server, since this runs on
+// every flushed metric.
+func (e *PrometheusExporter) Mirror(m Metric) {
+	defer func() {
+		if r := recover(); r != nil {
+			Error.Printf("Recovered from panic mirroring %s into Prometheus: %v", m.key, r)
+		}
+	}()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	switch m.metricType {
+	case "gauge":
+		g, err := e.gaugeFor(m)
+		if err != nil {
+			Error.Printf("Could not mirror gauge %s into Prometheus: %v", m.key, err)
+			return
+		}
+		g.Set(float64(m.lastValue))
+	case "counter":
+		c, err := e.counterFor(m)
+		if err != nil {
+			Error.Printf("Could not mirror counter %s into Prometheus: %v", m.key, err)
+			return
+		}
+		c.Add(float64(m.lastValue))
+	case "timer":
+		observer, err := e.timerFor(m)
+		if err != nil {
+			Error.Printf("Could not mirror timer %s into Prometheus: %v", m.key, err)
+			return
+		}
+		if m.histogram == nil {
+			return
+		}
+		// The histogram only retains bucketed counts, not raw samples, so
+		// replay each bucket's midpoint into the observer Count times.
+		for _, bar := range m.histogram.Distribution() {
+			if bar.Count == 0 {
+				continue
+			}
+			mid := float64(bar.From+bar.To) / 2
+			for i := int64(0); i < bar.Count; i++ {
+				observer.Observe(mid)
+			}
+		}
+	}
+}
+
+// sortedTagKeys returns tags' keys in sorted order, used as a metric's
+// Prometheus label names so the same name always declares the same labels.
+func sortedTagKeys(tags map[string]string) []string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (e *PrometheusExporter) gaugeFor(m Metric) (prometheus.Gauge, error) {
+	name := sanitizeMetricName(m.key)
+	vec, ok := e.gauges[name]
+	if !ok {
+		vec = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: e.namespace,
+			Subsystem: "gauges",
+			Name:      name,
+		}, sortedTagKeys(m.tags))
+		e.registry.MustRegister(vec)
+		e.gauges[name] = vec
+		e.labelNames[name] = sortedTagKeys(m.tags)
+	}
+	return vec.GetMetricWith(prometheus.Labels(m.tags))
+}
+
+func (e *PrometheusExporter) counterFor(m Metric) (prometheus.Counter, error) {
+	name := sanitizeMetricName(m.key)
+	vec, ok := e.counters[name]
+	if !ok {
+		vec = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: e.namespace,
+			Subsystem: "counters",
+			Name:      name,
+		}, sortedTagKeys(m.tags))
+		e.registry.MustRegister(vec)
+		e.counters[name] = vec
+		e.labelNames[name] = sortedTagKeys(m.tags)
+	}
+	return vec.GetMetricWith(prometheus.Labels(m.tags))
+}
+
+func (e *PrometheusExporter) timerFor(m Metric) (prometheus.Observer, error) {
+	name := sanitizeMetricName(m.key)
+	vec, ok := e.timers[name]
+	if !ok {
+		if len(e.buckets) > 0 {
+			vec = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+				Namespace: e.namespace,
+				Subsystem: "timers",
+				Name:      name,
+				Buckets:   e.buckets,
+			}, sortedTagKeys(m.tags))
+		} else {
+			vec = prometheus.NewSummaryVec(prometheus.SummaryOpts{
+				Namespace:  e.namespace,
+				Subsystem:  "timers",
+				Name:       name,
+				Objectives: e.objectives,
+			}, sortedTagKeys(m.tags))
+		}
+		e.registry.MustRegister(vec)
+		e.timers[name] = vec
+		e.labelNames[name] = sortedTagKeys(m.tags)
+	}
+	return vec.GetMetricWith(prometheus.Labels(m.tags))
+}
+
+// sanitizeMetricName replaces the dots and dashes of statsd keys, which
+// Prometheus doesn't allow in metric names, with underscores. Other
+// characters are left as they are.
+func sanitizeMetricName(key string) string {
+	return metricNameSanitizer.Replace(key)
+}
+
+var metricNameSanitizer = strings.NewReplacer(".", "_", "-", "_")
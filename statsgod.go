@@ -16,14 +16,15 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
+	"github.com/codahale/hdrhistogram"
 	"gopkg.in/yaml.v1"
 	"io"
 	"io/ioutil"
 	"log"
-	"math"
 	"net"
 	"os"
 	"regexp"
@@ -51,13 +52,42 @@ var (
 
 // Metric is our main data type.
 type Metric struct {
-	key         string    // Name of the metric.
-	metricType  string    // What type of metric is it (gauge, counter, timer)
-	totalHits   int       // Number of times it has been used.
-	lastValue   float32   // The last value stored.
-	allValues   []float32 // All of the values.
-	flushTime   int       // What time are we sending Graphite?
-	lastFlushed int       // When did we last flush this out?
+	key         string                  // Name of the metric.
+	tags        map[string]string       // Tag set attached to this metric, nil if untagged.
+	storeKey    string                  // Key under which this metric is indexed in MetricStore, incorporating tags.
+	metricType  string                  // What type of metric is it (gauge, counter, timer)
+	totalHits   int                     // Number of times it has been used.
+	lastValue   float32                 // The last value stored.
+	histogram   *hdrhistogram.Histogram // Timer samples, kept as bucketed counts to bound memory.
+	flushTime   int                     // What time are we sending Graphite?
+	lastFlushed int                     // When did we last flush this out?
+	sampleRate  float64                 // Sample rate this line was reported at, set by parseLine; 1 if unset.
+}
+
+// buildStoreKey derives the MetricStore key for a metric name and tag set.
+// Two metrics with the same name aggregate together only if their tag sets
+// are identical, so the tags are sorted by key and folded into the key:
+// "name;k1=v1;k2=v2".
+func buildStoreKey(name string, tags map[string]string) string {
+	if len(tags) == 0 {
+		return name
+	}
+
+	tagKeys := make([]string, 0, len(tags))
+	for k := range tags {
+		tagKeys = append(tagKeys, k)
+	}
+	sort.Strings(tagKeys)
+
+	var b strings.Builder
+	b.WriteString(name)
+	for _, k := range tagKeys {
+		b.WriteString(";")
+		b.WriteString(k)
+		b.WriteString("=")
+		b.WriteString(tags[k])
+	}
+	return b.String()
 }
 
 // MetricStore is storage for the metrics with locking.
@@ -78,6 +108,9 @@ const (
 
 var graphitePipeline = make(chan Metric, MAXREQS)
 
+// promExporter is non-nil when the `prometheus` config section is enabled.
+var promExporter *PrometheusExporter
+
 var config = flag.String("config", "config.yml", "YAML config file path")
 var debug = flag.Bool("debug", false, "Debugging mode")
 var host = flag.String("host", "localhost", "Hostname")
@@ -85,7 +118,6 @@ var port = flag.Int("port", 8125, "Port")
 var graphiteHost = flag.String("graphiteHost", "localhost", "Graphite Hostname")
 var graphitePort = flag.Int("graphitePort", 5001, "Graphite Port")
 var flushTime = flag.Duration("flushTime", 10*time.Second, "Flush time")
-var percentile = flag.Int("percentile", 90, "Percentile")
 
 func main() {
 	// Load command line options.
@@ -103,29 +135,45 @@ func main() {
 	Info.Printf("Loaded Config: %v", c)
 
 	addr := fmt.Sprintf("%s:%d", *host, *port)
-	Info.Printf("Starting stats server on %s", addr)
-
-	listener, err := net.Listen("tcp", addr)
-	if err != nil {
-		checkError(err, "Starting Server", true)
-	}
+	Info.Printf("Starting stats server on %s (%s)", addr, protocol)
 
 	var store = NewMetricStore()
 
+	backends = buildBackends(store)
+
 	// Every X seconds we want to flush the metrics
 	go flushMetrics(store)
 
 	// Constantly process background Graphite queue.
 	go handleGraphiteQueue(store)
 
-	for {
-		conn, err := listener.Accept()
-		// TODO: handle errors with one client gracefully.
+	if promConfig.Enabled {
+		promExporter = NewPrometheusExporter(promConfig)
+		go promExporter.Serve(promConfig.ListenAddr)
+		go handlePrometheusQueue()
+	}
+
+	if protocol == "udp" || protocol == "both" {
+		go listenUDP(addr, store)
+	}
+
+	if protocol == "tcp" || protocol == "both" {
+		listener, err := net.Listen("tcp", addr)
 		if err != nil {
-			checkError(err, "Accepting Connection", false)
+			checkError(err, "Starting Server", true)
+		}
+
+		for {
+			conn, err := listener.Accept()
+			// TODO: handle errors with one client gracefully.
+			if err != nil {
+				checkError(err, "Accepting Connection", false)
+			}
+			go handleRequest(conn, store)
 		}
-		go handleRequest(conn, store)
 	}
+
+	select {}
 }
 
 func logInit(
@@ -192,16 +240,185 @@ func loadConfig(c string) map[interface{}]interface{} {
 		*graphitePort = m["graphitePort"].(int)
 	}
 
-	if m["percentile"] != nil && touchedFlags["percentile"] != 1 {
-		*percentile = m["percentile"].(int)
+	if m["percentiles"] != nil {
+		raw := m["percentiles"].([]interface{})
+		percentiles := make([]float64, len(raw))
+		for i, v := range raw {
+			percentiles[i] = toFloat64(v)
+		}
+		timerConfig.Percentiles = percentiles
+	}
+
+	if m["timers"] != nil {
+		parseTimerConfig(m["timers"].(map[interface{}]interface{}))
+	}
+
+	if m["tagFormat"] != nil {
+		tagFormat = m["tagFormat"].(string)
+	}
+
+	if m["protocol"] != nil {
+		protocol = m["protocol"].(string)
+	}
+
+	if m["udp"] != nil {
+		udpSection := m["udp"].(map[interface{}]interface{})
+		if udpSection["mtu"] != nil {
+			udpMTU = udpSection["mtu"].(int)
+		}
+	}
+
+	if m["prometheus"] != nil {
+		parsePrometheusConfig(m["prometheus"].(map[interface{}]interface{}))
+	}
+
+	if m["graphite"] != nil {
+		parseGraphiteConfig(m["graphite"].(map[interface{}]interface{}))
+	}
+
+	if m["backends"] != nil {
+		parseBackendsConfig(m["backends"].([]interface{}))
+	}
+
+	if m["filters"] != nil {
+		parseFilterConfig(m["filters"].(map[interface{}]interface{}))
 	}
 
 	return m
 }
 
+// parseGraphiteConfig reads the `graphite` YAML section into graphiteConfig.
+func parseGraphiteConfig(m map[interface{}]interface{}) {
+	if m["dialTimeout"] != nil {
+		d, err := time.ParseDuration(m["dialTimeout"].(string))
+		checkError(err, "Could not parse graphite.dialTimeout", true)
+		graphiteConfig.DialTimeout = d
+	}
+
+	if m["writeTimeout"] != nil {
+		d, err := time.ParseDuration(m["writeTimeout"].(string))
+		checkError(err, "Could not parse graphite.writeTimeout", true)
+		graphiteConfig.WriteTimeout = d
+	}
+
+	if m["spoolSize"] != nil {
+		graphiteConfig.SpoolSize = m["spoolSize"].(int)
+	}
+
+	if m["reconnectBackoff"] != nil {
+		d, err := time.ParseDuration(m["reconnectBackoff"].(string))
+		checkError(err, "Could not parse graphite.reconnectBackoff", true)
+		graphiteConfig.ReconnectBackoff = d
+	}
+
+	if m["reconnectMax"] != nil {
+		d, err := time.ParseDuration(m["reconnectMax"].(string))
+		checkError(err, "Could not parse graphite.reconnectMax", true)
+		graphiteConfig.ReconnectMax = d
+	}
+}
+
+// parsePrometheusConfig reads the `prometheus` YAML section into promConfig.
+func parsePrometheusConfig(m map[interface{}]interface{}) {
+	promConfig.Enabled = true
+
+	if m["listen"] != nil {
+		promConfig.ListenAddr = m["listen"].(string)
+	}
+
+	if m["namespace"] != nil {
+		promConfig.Namespace = m["namespace"].(string)
+	}
+
+	if m["buckets"] != nil {
+		raw := m["buckets"].([]interface{})
+		buckets := make([]float64, len(raw))
+		for i, v := range raw {
+			buckets[i] = toFloat64(v)
+		}
+		promConfig.Buckets = buckets
+	}
+
+	if m["percentiles"] != nil {
+		raw := m["percentiles"].([]interface{})
+		percentiles := make([]float64, len(raw))
+		for i, v := range raw {
+			percentiles[i] = toFloat64(v)
+		}
+		promConfig.Percentiles = percentiles
+	}
+}
+
+// toFloat64 normalizes the int/float64 values the YAML decoder can hand back
+// for a numeric list entry.
+func toFloat64(v interface{}) float64 {
+	switch n := v.(type) {
+	case float64:
+		return n
+	case int:
+		return float64(n)
+	}
+	return 0
+}
+
+// metricLineRegexp matches a single statsd line: `name:value|type` with an
+// optional statsd sample-rate suffix `|@0.1` and/or a trailing DogStatsD-style
+// tag suffix `|#tag1:v1,tag2:v2`.
+var metricLineRegexp = regexp.MustCompile(`^([^:]+):([^|]+)\|([^|]+)(?:\|@([^|]+))?(?:\|#(.+))?$`)
+
+// parseLine parses a single statsd line into a Metric carrying its key,
+// type, value, and tags. Counter values are pre-divided by the sample rate
+// here; timer sample-rate weighting is carried in the returned sampleRate
+// for the caller to apply via MetricStore.Set.
+func parseLine(line string) (Metric, error) {
+	bits := metricLineRegexp.FindStringSubmatch(line)
+	if bits == nil {
+		return Metric{}, fmt.Errorf("malformed statsd line: %q", line)
+	}
+
+	metricType, err := shortTypeToLong(bits[3])
+	if err != nil {
+		return Metric{}, err
+	}
+
+	value, err := strconv.ParseFloat(bits[2], 32)
+	if err != nil {
+		return Metric{}, err
+	}
+
+	sampleRate := 1.0
+	if bits[4] != "" {
+		sampleRate, err = strconv.ParseFloat(bits[4], 64)
+		if err != nil {
+			return Metric{}, err
+		}
+	}
+
+	lastValue := float32(value)
+	if metricType == "counter" && sampleRate > 0 {
+		lastValue = lastValue / float32(sampleRate)
+	}
+
+	return Metric{
+		key:        bits[1],
+		metricType: metricType,
+		lastValue:  lastValue,
+		tags:       parseTags(bits[5]),
+		sampleRate: sampleRate,
+	}, nil
+}
+
+// timerWeight returns how many times a timer sample should be recorded to
+// account for its sample rate, rounding to the nearest integer.
+func timerWeight(sampleRate float64) int64 {
+	if sampleRate <= 0 {
+		return 1
+	}
+	return int64(1/sampleRate + 0.5)
+}
+
 func handleRequest(conn net.Conn, store *MetricStore) {
 	for {
-		var metric, val, metricType string
 		buf := make([]byte, 512)
 		_, err := conn.Read(buf)
 		if err != nil {
@@ -210,35 +427,46 @@ func handleRequest(conn net.Conn, store *MetricStore) {
 		}
 		defer conn.Close()
 
-		Trace.Printf("Got from client: %s", strings.Trim(string(buf), "\x0a"))
-
-		msg := regexp.MustCompile(`(.*)\:(.*)\|(.*)`)
-		bits := msg.FindAllStringSubmatch(string(buf), 1)
-		if len(bits) != 0 {
-			metric = bits[0][1]
-			val = bits[0][2]
-			tmpMetricType := bits[0][3]
-			tmpMetricType = strings.TrimSpace(tmpMetricType)
-			tmpMetricType = strings.Trim(tmpMetricType, "\x00")
-			metricType, err = shortTypeToLong(tmpMetricType)
-			Trace.Printf("Metric Type Is: %v (~%v)", metricType, tmpMetricType)
-			if err != nil {
-				Warning.Printf("Problem handling metric of type: %s", tmpMetricType)
-				continue
-			}
-		} else {
-			Warning.Printf("Error processing client message: %s", string(buf))
-			return
+		line := strings.TrimRight(string(buf), "\x00")
+		line = strings.TrimSpace(line)
+
+		Trace.Printf("Got from client: %s", line)
+
+		parsed, err := parseLine(line)
+		if err != nil {
+			Warning.Printf("Error processing client message: %v", err)
+			continue
 		}
 
-		// TODO - this float parsing is ugly.
-		value, err := strconv.ParseFloat(val, 32)
-		checkError(err, "Converting Value", false)
+		Trace.Printf("(%s) %s %v => %f", parsed.metricType, parsed.key, parsed.tags, parsed.lastValue)
+
+		weight := int64(1)
+		if parsed.metricType == "timer" {
+			weight = timerWeight(parsed.sampleRate)
+		}
+		store.Set(parsed.key, parsed.metricType, parsed.lastValue, parsed.tags, weight)
+	}
+}
 
-		Trace.Printf("(%s) %s => %f", metricType, metric, value)
+// parseTags turns a DogStatsD tag suffix ("tag1:v1,tag2:v2") into a map.
+// Returns nil if raw carries no tags.
+func parseTags(raw string) map[string]string {
+	raw = strings.TrimSpace(raw)
+	raw = strings.Trim(raw, "\x00")
+	if raw == "" {
+		return nil
+	}
 
-		store.Set(metric, metricType, float32(value))
+	tags := make(map[string]string)
+	for _, pair := range strings.Split(raw, ",") {
+		kv := strings.SplitN(pair, ":", 2)
+		if len(kv) != 2 {
+			Warning.Printf("Ignoring malformed tag: %s", pair)
+			continue
+		}
+		tags[kv[0]] = kv[1]
 	}
+	return tags
 }
 
 func flushMetrics(store *MetricStore) {
@@ -249,14 +477,19 @@ func flushMetrics(store *MetricStore) {
 		select {
 		case <-flushTicker:
 			Trace.Println("Tick...")
-			for index, metric := range store.metrics {
-				Trace.Printf("Flushing %s (%s) => %g %v", index, metric.metricType, metric.lastValue, metric.allValues)
+			metrics := store.Snapshot()
+
+			for _, metric := range metrics {
+				Trace.Printf("Flushing %s (%s) => %g (%d hits)", metric.storeKey, metric.metricType, metric.lastValue, metric.totalHits)
 			}
 
-			for _, metric := range store.metrics {
+			for _, metric := range metrics {
 				flushTime := int(time.Now().Unix())
 				metric.flushTime = flushTime
 				graphitePipeline <- metric
+				if promConfig.Enabled {
+					promPipeline <- metric
+				}
 			}
 		}
 	}
@@ -265,95 +498,121 @@ func flushMetrics(store *MetricStore) {
 func handleGraphiteQueue(store *MetricStore) {
 	for {
 		metric := <-graphitePipeline
-		go sendToGraphite(metric)
+		samples := buildSamples(metric)
+
+		for _, b := range backends {
+			go func(b Backend) {
+				if err := b.Send(context.Background(), samples); err != nil {
+					Error.Printf("Backend %s failed to send: %v", b.Name(), err)
+				}
+			}(b)
+		}
+
+		// Gauges always stay in place, continuously overwritten by new
+		// Sets. Other types follow the configured (or Prometheus-forced)
+		// reset-on-flush policy: reset in place (etsy-statsd semantics) or
+		// delete entirely.
 		if metric.metricType != "gauge" {
-			delete(store.metrics, metric.key)
+			if filterConfig.shouldReset(metric.metricType) {
+				store.ResetAfterFlush(metric.storeKey)
+			} else {
+				store.Delete(metric.storeKey)
+			}
 		}
 	}
 }
 
-func sendToGraphite(m Metric) {
-	stringTime := strconv.Itoa(m.flushTime)
-	var gkey string
-
-	defer Info.Println("Done sending to Graphite")
-
-	//Determine why this checkError wasn't working.
-	//checkError(err, "Problem sending to graphite", false)
-
-	// TODO for metrics
-	// http://blog.pkhamre.com/2012/07/24/understanding-statsd-and-graphite/
-	// Ensure all of the metrics are working correctly.
-
-	if m.metricType == "gauge" {
-		gkey = fmt.Sprintf("stats.gauges.%s.avg_value", m.key)
-		sendSingleMetricToGraphite(gkey, m.lastValue, stringTime)
-	} else if m.metricType == "counter" {
-		flushSeconds := time.Duration.Seconds(*flushTime)
-		valuePerSec := m.lastValue / float32(flushSeconds)
+// handlePrometheusQueue mirrors flushed metrics into the Prometheus exporter.
+func handlePrometheusQueue() {
+	for {
+		metric := <-promPipeline
+		promExporter.Mirror(metric)
+	}
+}
 
-		gkey = fmt.Sprintf("stats.%s", m.key)
-		sendSingleMetricToGraphite(gkey, valuePerSec, stringTime)
+// tagFormat selects how tags are rendered on egress to Graphite: "graphite"
+// uses Carbon's native tag syntax, "none" mangles tags into the dotted name
+// for compatibility with older Carbon installs that don't understand tags.
+var tagFormat = "none"
 
-		gkey = fmt.Sprintf("stats_counts.%s", m.key)
-		sendSingleMetricToGraphite(gkey, m.lastValue, stringTime)
+// formatKeyWithTags folds tags into key per tagFormat, the same way every
+// text-based backend (plaintext Graphite, Carbon pickle) names a datapoint.
+func formatKeyWithTags(key string, tags map[string]string) string {
+	if len(tags) == 0 {
+		return key
 	}
 
-	sendSingleMetricToGraphite(m.key, m.lastValue, stringTime)
-
-	if m.metricType != "timer" {
-		Trace.Println("Not a timer, so skipping additional graphite points")
-		return
+	tagKeys := make([]string, 0, len(tags))
+	for k := range tags {
+		tagKeys = append(tagKeys, k)
 	}
+	sort.Strings(tagKeys)
 
-	// Handle timer specific calls.
-	sort.Sort(ByFloat32(m.allValues))
-	Trace.Printf("Sorted Vals: %v", m.allValues)
+	if tagFormat == "graphite" {
+		parts := []string{key}
+		for _, k := range tagKeys {
+			parts = append(parts, fmt.Sprintf("%s=%s", k, tags[k]))
+		}
+		return strings.Join(parts, ";")
+	}
 
-	// Calculate the math values for the timer.
-	minValue := m.allValues[0]
-	maxValue := m.allValues[len(m.allValues)-1]
+	name := key
+	for _, k := range tagKeys {
+		name = fmt.Sprintf("%s.%s.%s", name, k, tags[k])
+	}
+	return name
+}
 
-	sum := float32(0)
-	cumulativeValues := []float32{minValue}
-	for idx, value := range m.allValues {
-		sum += value
+// buildSamples expands a flushed Metric into the Samples every backend
+// fans out, mirroring the stats.*/stats_counts.*/stats.timers.* naming
+// scheme Etsy's statsd popularized.
+func buildSamples(m Metric) []Sample {
+	name := filterConfig.Prefix + formatKeyWithTags(m.key, m.tags) + filterConfig.Suffix
+	timestamp := int64(m.flushTime)
 
-		if idx != 0 {
-			cumulativeValues = append(cumulativeValues, cumulativeValues[idx-1]+value)
-		}
+	sample := func(key string, value float32) Sample {
+		return Sample{Key: key, Value: float64(value), Timestamp: timestamp, Tags: m.tags}
 	}
-	avgValue := sum / float32(m.totalHits)
 
-	gkey = fmt.Sprintf("stats.timers.%s.avg_value", m.key)
-	sendSingleMetricToGraphite(gkey, avgValue, stringTime)
+	var samples []Sample
 
-	gkey = fmt.Sprintf("stats.timers.%s.max_value", m.key)
-	sendSingleMetricToGraphite(gkey, maxValue, stringTime)
+	switch m.metricType {
+	case "gauge":
+		samples = append(samples, sample(fmt.Sprintf("stats.gauges.%s.avg_value", name), m.lastValue))
+	case "counter":
+		flushSeconds := time.Duration.Seconds(*flushTime)
+		valuePerSec := m.lastValue / float32(flushSeconds)
 
-	gkey = fmt.Sprintf("stats.timers.%s.min_value", m.key)
-	sendSingleMetricToGraphite(gkey, minValue, stringTime)
-	// All of the percentile based value calculations.
+		samples = append(samples, sample(fmt.Sprintf("stats.%s", name), valuePerSec))
+		samples = append(samples, sample(fmt.Sprintf("stats_counts.%s", name), m.lastValue))
+	}
 
-	thresholdIndex := int(math.Floor((((100 - float64(*percentile)) / 100) * float64(m.totalHits)) + 0.5))
-	numInThreshold := m.totalHits - thresholdIndex
+	samples = append(samples, sample(name, m.lastValue))
 
-	maxAtThreshold := m.allValues[numInThreshold-1]
-	Trace.Printf("Key: %s | Total Vals: %d | Threshold IDX: %d | How many in threshold? %d | Max at threshold: %f", m.key, m.totalHits, thresholdIndex, numInThreshold, maxAtThreshold)
+	if m.metricType != "timer" {
+		return samples
+	}
 
-	Trace.Printf("Cumultative Values: %v", cumulativeValues)
+	// Timer stats are read off the HDR histogram rather than raw samples so
+	// memory stays bounded regardless of sample rate.
+	h := m.histogram
+	flushSeconds := time.Duration.Seconds(*flushTime)
 
-	// Take the cumulative at the threshold and divide by the threshold idx.
-	meanAtPercentile := cumulativeValues[numInThreshold-1] / float32(numInThreshold)
+	samples = append(samples, sample(fmt.Sprintf("stats.timers.%s.count", name), float32(h.TotalCount())))
+	samples = append(samples, sample(fmt.Sprintf("stats.timers.%s.count_ps", name), float32(h.TotalCount())/float32(flushSeconds)))
+	samples = append(samples, sample(fmt.Sprintf("stats.timers.%s.std", name), float32(h.StdDev())))
+	samples = append(samples, sample(fmt.Sprintf("stats.timers.%s.median", name), float32(h.ValueAtQuantile(50))))
 
-	gkey = fmt.Sprintf("stats.timers.%s.mean_%d", m.key, *percentile)
-	sendSingleMetricToGraphite(gkey, meanAtPercentile, stringTime)
+	for _, p := range timerConfig.Percentiles {
+		upper, mean, sum := percentileStats(h, p)
+		suffix := formatPercentileSuffix(p)
 
-	gkey = fmt.Sprintf("stats.timers.%s.upper_%d", m.key, *percentile)
-	sendSingleMetricToGraphite(gkey, maxAtThreshold, stringTime)
+		samples = append(samples, sample(fmt.Sprintf("stats.timers.%s.upper_%s", name, suffix), upper))
+		samples = append(samples, sample(fmt.Sprintf("stats.timers.%s.mean_%s", name, suffix), mean))
+		samples = append(samples, sample(fmt.Sprintf("stats.timers.%s.sum_%s", name, suffix), sum))
+	}
 
-	gkey = fmt.Sprintf("stats.timers.%s.sum_%d", m.key, *percentile)
-	sendSingleMetricToGraphite(gkey, cumulativeValues[numInThreshold-1], stringTime)
+	return samples
 }
 
 // NewMetricStore Initialize the metric store.
@@ -370,15 +629,45 @@ func (s *MetricStore) Get(key string) Metric {
 	return m
 }
 
-// Set will store or update a metric.
-func (s *MetricStore) Set(key string, metricType string, val float32) bool {
+// Snapshot returns a copy of every stored metric, taken under a read lock
+// so callers can range over it without racing Set/Delete/ResetAfterFlush
+// mutating the underlying map from other goroutines.
+func (s *MetricStore) Snapshot() []Metric {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	snapshot := make([]Metric, 0, len(s.metrics))
+	for _, m := range s.metrics {
+		snapshot = append(snapshot, m)
+	}
+	return snapshot
+}
+
+// Set will store or update a metric. The (name, sorted tags) pair is the
+// metric's identity: two callers with the same name but different tag sets
+// are tracked separately. weight is the number of times a timer sample
+// should be recorded into the histogram, to account for a statsd sample
+// rate; callers outside the statsd sample-rate path should pass 1.
+// Metrics rejected by the configured deny/allow filters are never stored,
+// so they don't allocate a MetricStore entry. Accepted keys are run through
+// the configured rewrite rules before storage. Returns true if the metric
+// was stored, false if it was filtered out.
+func (s *MetricStore) Set(key string, metricType string, val float32, tags map[string]string, weight int64) bool {
+	if !filterConfig.accepts(key) {
+		return false
+	}
+	key = filterConfig.rewrite(key)
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	m, existingMetric := s.metrics[key]
+	storeKey := buildStoreKey(key, tags)
+	m, existingMetric := s.metrics[storeKey]
 
 	if !existingMetric {
 		m.key = key
+		m.tags = tags
+		m.storeKey = storeKey
 		m.totalHits = 1
 		m.lastValue = val
 		m.metricType = metricType
@@ -387,6 +676,7 @@ func (s *MetricStore) Set(key string, metricType string, val float32) bool {
 		case metricType == "gauge":
 		case metricType == "counter":
 		case metricType == "timer":
+			m.histogram = newTimerHistogram()
 		}
 	} else {
 		m.totalHits++
@@ -402,29 +692,52 @@ func (s *MetricStore) Set(key string, metricType string, val float32) bool {
 
 	}
 
-	// TODO: should we bother trackin this for counters?
-	m.allValues = append(m.allValues, val)
-	s.metrics[key] = m
+	if metricType == "timer" {
+		if weight < 1 {
+			weight = 1
+		}
+		if err := m.histogram.RecordValues(int64(val), weight); err != nil {
+			Warning.Printf("Timer %s: could not record value %v (out of configured histogram range?): %v", key, val, err)
+		}
+	}
+	s.metrics[storeKey] = m
 
-	return false
+	return true
 }
 
-// sendSingleMetricToGraphite formats a message and a value and time and sends to Graphite.
-func sendSingleMetricToGraphite(key string, v float32, t string) {
-	c, err := net.Dial("tcp", fmt.Sprintf("%s:%d", *graphiteHost, *graphitePort))
-	if err != nil {
-		Error.Println("Could not connect to remote graphite server")
-		return
-	}
+// Delete removes a metric from the store entirely.
+func (s *MetricStore) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.metrics, key)
+}
 
-	defer c.Close()
+// ResetAfterFlush clears a metric's flush-window state (hit count and
+// sampled values) while keeping it in the store, so a Prometheus collector
+// backing it keeps accumulating across flushes instead of resetting.
+// Counters additionally have lastValue zeroed: Set accumulates into it
+// (m.lastValue += val), so leaving it in place would make every
+// subsequent window report the cumulative total since creation instead of
+// that window's delta. Gauges and timers keep their lastValue, since a
+// gauge's lastValue is its current reading (not a per-window delta) and a
+// timer's stats are read off the histogram, which is reset above.
+func (s *MetricStore) ResetAfterFlush(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	sv := strconv.FormatFloat(float64(v), 'f', 6, 32)
-	payload := fmt.Sprintf("%s %s %s", key, sv, t)
-	Trace.Printf("Payload: %v", payload)
+	m, ok := s.metrics[key]
+	if !ok {
+		return
+	}
 
-	// Send to the connection
-	fmt.Fprintf(c, fmt.Sprintf("%s %v %s\n", key, sv, t))
+	m.totalHits = 0
+	if m.metricType == "counter" {
+		m.lastValue = 0
+	}
+	if m.histogram != nil {
+		m.histogram.Reset()
+	}
+	s.metrics[key] = m
 }
 
 func shortTypeToLong(short string) (string, error) {
@@ -439,13 +752,6 @@ func shortTypeToLong(short string) (string, error) {
 	return "unknown", errors.New("unknown metric type")
 }
 
-// ByFloat32 implements sort.Interface for []Float32.
-type ByFloat32 []float32
-
-func (a ByFloat32) Len() int           { return len(a) }
-func (a ByFloat32) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-func (a ByFloat32) Less(i, j int) bool { return a[i] < a[j] }
-
 func logger(msg string) {
 	fmt.Println(msg)
 }
@@ -0,0 +1,93 @@
+/**
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/codahale/hdrhistogram"
+)
+
+// TimerConfig holds the settings backing the HDR histogram every timer
+// metric is recorded into.
+type TimerConfig struct {
+	Percentiles []float64
+	Min         int64
+	Max         int64
+	SigFigs     int
+}
+
+// timerConfig is the active timer configuration, populated by loadConfig.
+var timerConfig = TimerConfig{
+	Percentiles: []float64{90},
+	Min:         0,
+	Max:         60000,
+	SigFigs:     3,
+}
+
+// parseTimerConfig reads the `timers` YAML section into timerConfig.
+func parseTimerConfig(m map[interface{}]interface{}) {
+	if m["min"] != nil {
+		timerConfig.Min = int64(toFloat64(m["min"]))
+	}
+
+	if m["max"] != nil {
+		timerConfig.Max = int64(toFloat64(m["max"]))
+	}
+
+	if m["sigfigs"] != nil {
+		timerConfig.SigFigs = m["sigfigs"].(int)
+	}
+}
+
+// newTimerHistogram builds an HDR histogram sized per timerConfig.
+func newTimerHistogram() *hdrhistogram.Histogram {
+	return hdrhistogram.New(timerConfig.Min, timerConfig.Max, timerConfig.SigFigs)
+}
+
+// percentileStats reads the upper value, mean, and sum of all samples at or
+// below the p-th percentile off h. Since the HDR histogram only retains
+// bucketed counts rather than raw samples, mean/sum are approximated from
+// each bucket's midpoint rather than computed exactly.
+func percentileStats(h *hdrhistogram.Histogram, p float64) (upper, mean, sum float32) {
+	threshold := h.ValueAtQuantile(p)
+	upper = float32(threshold)
+
+	var count int64
+	for _, bar := range h.Distribution() {
+		if bar.Count == 0 {
+			continue
+		}
+		if bar.From > threshold {
+			break
+		}
+		mid := float32(bar.From+bar.To) / 2
+		sum += mid * float32(bar.Count)
+		count += bar.Count
+	}
+
+	if count > 0 {
+		mean = sum / float32(count)
+	}
+	return
+}
+
+// formatPercentileSuffix renders a percentile for use in a Graphite metric
+// name segment, e.g. 90 -> "90", 99.9 -> "99_9".
+func formatPercentileSuffix(p float64) string {
+	s := strconv.FormatFloat(p, 'f', -1, 64)
+	return strings.Replace(s, ".", "_", 1)
+}
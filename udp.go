@@ -0,0 +1,86 @@
+/**
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+// defaultUDPMTU is the default per-read buffer size, matching the
+// conventional statsd default (1472 bytes fits in a single Ethernet frame
+// without IP fragmentation).
+const defaultUDPMTU = 1472
+
+// protocol selects which listener(s) to start: "tcp" (default), "udp", or
+// "both".
+var protocol = "tcp"
+
+// udpMTU is the per-datagram read buffer size, configurable via the `udp`
+// YAML section.
+var udpMTU = defaultUDPMTU
+
+// listenUDP starts a UDP listener on addr, splitting each datagram on "\n"
+// and pushing every line through the shared parseLine helper. Real statsd
+// clients batch several metrics into a single datagram, unlike the
+// one-metric-per-read TCP handler.
+func listenUDP(addr string, store *MetricStore) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		checkError(err, "Resolving UDP address", true)
+	}
+
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		checkError(err, "Starting UDP listener", true)
+	}
+	Info.Printf("Starting UDP stats listener on %s", addr)
+
+	for {
+		buf := make([]byte, udpMTU)
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			checkError(err, "Reading UDP packet", false)
+			continue
+		}
+
+		go handleUDPPacket(buf[:n], store)
+	}
+}
+
+// handleUDPPacket parses every newline-separated metric in a single
+// datagram and records it.
+func handleUDPPacket(payload []byte, store *MetricStore) {
+	for _, line := range strings.Split(string(payload), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		parsed, err := parseLine(line)
+		if err != nil {
+			Warning.Printf("Error processing UDP datagram line: %v", err)
+			continue
+		}
+
+		Trace.Printf("(%s) %s %v => %f", parsed.metricType, parsed.key, parsed.tags, parsed.lastValue)
+
+		weight := int64(1)
+		if parsed.metricType == "timer" {
+			weight = timerWeight(parsed.sampleRate)
+		}
+		store.Set(parsed.key, parsed.metricType, parsed.lastValue, parsed.tags, weight)
+	}
+}
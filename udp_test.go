@@ -0,0 +1,188 @@
+/**
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// TestMain initializes the package log handles before any test runs, since
+// handleUDPPacket/parseLine log through Trace/Warning/etc., which are only
+// otherwise set up by logInit() inside main().
+func TestMain(m *testing.M) {
+	logInit(io.Discard, io.Discard, io.Discard, io.Discard)
+	os.Exit(m.Run())
+}
+
+func TestParseLine(t *testing.T) {
+	cases := []struct {
+		name       string
+		line       string
+		wantErr    bool
+		key        string
+		metricType string
+		lastValue  float32
+		sampleRate float64
+		tags       map[string]string
+	}{
+		{
+			name:       "counter",
+			line:       "requests:1|c",
+			key:        "requests",
+			metricType: "counter",
+			lastValue:  1,
+			sampleRate: 1,
+		},
+		{
+			name:       "gauge",
+			line:       "queue.depth:42|g",
+			key:        "queue.depth",
+			metricType: "gauge",
+			lastValue:  42,
+			sampleRate: 1,
+		},
+		{
+			name:       "timer",
+			line:       "api.latency:123.5|ms",
+			key:        "api.latency",
+			metricType: "timer",
+			lastValue:  123.5,
+			sampleRate: 1,
+		},
+		{
+			name:       "counter with sample rate scales value",
+			line:       "requests:1|c|@0.1",
+			key:        "requests",
+			metricType: "counter",
+			lastValue:  10,
+			sampleRate: 0.1,
+		},
+		{
+			name:       "timer with sample rate keeps raw value",
+			line:       "api.latency:50|ms|@0.5",
+			key:        "api.latency",
+			metricType: "timer",
+			lastValue:  50,
+			sampleRate: 0.5,
+		},
+		{
+			name:       "tag suffix",
+			line:       "requests:1|c|#host:web1,env:prod",
+			key:        "requests",
+			metricType: "counter",
+			lastValue:  1,
+			sampleRate: 1,
+			tags:       map[string]string{"host": "web1", "env": "prod"},
+		},
+		{
+			name:       "sample rate and tags together",
+			line:       "requests:1|c|@0.5|#host:web1",
+			key:        "requests",
+			metricType: "counter",
+			lastValue:  2,
+			sampleRate: 0.5,
+			tags:       map[string]string{"host": "web1"},
+		},
+		{
+			name:    "missing pipe is malformed",
+			line:    "requests:1",
+			wantErr: true,
+		},
+		{
+			name:    "missing value is malformed",
+			line:    "requests|c",
+			wantErr: true,
+		},
+		{
+			name:    "unknown type",
+			line:    "requests:1|bogus",
+			wantErr: true,
+		},
+		{
+			name:    "non-numeric value",
+			line:    "requests:abc|c",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			m, err := parseLine(tc.line)
+
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("parseLine(%q) = %+v, want error", tc.line, m)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("parseLine(%q) returned unexpected error: %v", tc.line, err)
+			}
+			if m.key != tc.key {
+				t.Errorf("key = %q, want %q", m.key, tc.key)
+			}
+			if m.metricType != tc.metricType {
+				t.Errorf("metricType = %q, want %q", m.metricType, tc.metricType)
+			}
+			if m.lastValue != tc.lastValue {
+				t.Errorf("lastValue = %v, want %v", m.lastValue, tc.lastValue)
+			}
+			if m.sampleRate != tc.sampleRate {
+				t.Errorf("sampleRate = %v, want %v", m.sampleRate, tc.sampleRate)
+			}
+			if !reflect.DeepEqual(m.tags, tc.tags) {
+				t.Errorf("tags = %#v, want %#v", m.tags, tc.tags)
+			}
+		})
+	}
+}
+
+func TestHandleUDPPacketMultiMetricDatagram(t *testing.T) {
+	store := NewMetricStore()
+
+	payload := "requests:1|c\ngauge.value:7|g\n\napi.latency:100|ms|#host:web1\n"
+	handleUDPPacket([]byte(payload), store)
+
+	if got := store.Get("requests").lastValue; got != 1 {
+		t.Errorf("requests lastValue = %v, want 1", got)
+	}
+	if got := store.Get("gauge.value").lastValue; got != 7 {
+		t.Errorf("gauge.value lastValue = %v, want 7", got)
+	}
+
+	tagged := store.Get(buildStoreKey("api.latency", map[string]string{"host": "web1"}))
+	if tagged.lastValue != 100 {
+		t.Errorf("api.latency lastValue = %v, want 100", tagged.lastValue)
+	}
+	if tagged.histogram == nil {
+		t.Errorf("api.latency histogram = nil, want recorded samples")
+	}
+}
+
+func TestHandleUDPPacketSkipsMalformedLines(t *testing.T) {
+	store := NewMetricStore()
+
+	payload := "requests:1|c\nnot-a-valid-line\nrequests:1|c\n"
+	handleUDPPacket([]byte(payload), store)
+
+	got := store.Get("requests")
+	if got.totalHits != 2 {
+		t.Errorf("requests totalHits = %d, want 2 (malformed line should be skipped, not abort the datagram)", got.totalHits)
+	}
+}